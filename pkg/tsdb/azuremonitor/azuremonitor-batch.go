@@ -0,0 +1,346 @@
+package azuremonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/tsdb"
+)
+
+const (
+	metricsGetBatchAPIVersion = "2023-10-01"
+
+	// defaultMaxBatchSize is the number of resourceIds Azure Monitor
+	// accepts in a single metrics:getBatch request; overridable
+	// per-datasource via the "metricsBatchSize" JsonData setting.
+	defaultMaxBatchSize = 50
+)
+
+// crossResourceQuery is a crossResource query still waiting to be
+// resolved into timeseries, kept separate from AzureMonitorQuery so it
+// can be grouped and batched across resources.
+type crossResourceQuery struct {
+	query            *tsdb.Query
+	azureMonitorData AzureMonitorData
+	startTime        time.Time
+	endTime          time.Time
+}
+
+// batchResourceGroup is a set of resources that share a metric
+// definition, region and time grain and so can be fetched together with
+// a single metrics:getBatch call.
+type batchResourceGroup struct {
+	Subscription     string
+	MetricDefinition string
+	Location         string
+	TimeGrain        string
+	Resources        []resource
+}
+
+// batchRequestError wraps a non-2xx response from metrics:getBatch so
+// callers can tell a retryable/fallback-worthy 4xx apart from a genuine
+// failure.
+type batchRequestError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *batchRequestError) Error() string {
+	return fmt.Sprintf("metrics:getBatch request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func isBatchClientError(err error) bool {
+	var batchErr *batchRequestError
+	if errors.As(err, &batchErr) {
+		return batchErr.StatusCode/100 == 4
+	}
+	return false
+}
+
+// executeCrossResourceQuery resolves a crossResource query by grouping
+// its resources by metric definition, region and time grain, and
+// requesting each group's metrics in bulk via metrics:getBatch. Groups
+// rejected by the batch endpoint (older regions) fall back to one
+// request per resource.
+func (e *AzureMonitorDatasource) executeCrossResourceQuery(ctx context.Context, cr *crossResourceQuery, timeRange *tsdb.TimeRange) (*tsdb.QueryResult, error) {
+	queryRes := &tsdb.QueryResult{Meta: simplejson.New(), RefId: cr.query.RefId}
+
+	subscriptions := cr.query.Model.Get("subscriptions").MustArray()
+	resources, err := e.getResources(ctx, &cr.azureMonitorData, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	timeGrain, err := e.resolveTimeGrain(cr.query.IntervalMs, &cr.azureMonitorData)
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := e.dsInfo.JsonData.Get("metricsBatchSize").MustInt(defaultMaxBatchSize)
+	if batchSize < 1 {
+		batchSize = defaultMaxBatchSize
+	}
+
+	for _, group := range groupResourcesForBatching(resources, timeGrain) {
+		for _, chunk := range chunkResources(group.Resources, batchSize) {
+			series, err := e.executeBatchGroupQuery(ctx, cr, group, chunk, timeGrain)
+			if err != nil {
+				if !isBatchClientError(err) {
+					return nil, err
+				}
+
+				azlog.Debug("AzureMonitor", "metrics:getBatch rejected, falling back to per-resource queries", "error", err)
+				series, err = e.executeResourceFallbackQueries(ctx, cr, chunk, timeRange)
+				if err != nil {
+					return nil, err
+				}
+			}
+			queryRes.Series = append(queryRes.Series, series...)
+		}
+	}
+
+	return queryRes, nil
+}
+
+// executeResourceFallbackQueries requests metrics one resource at a time,
+// the same way a non-batched crossResource query always did.
+func (e *AzureMonitorDatasource) executeResourceFallbackQueries(ctx context.Context, cr *crossResourceQuery, resources []resource, timeRange *tsdb.TimeRange) ([]*tsdb.TimeSeries, error) {
+	fallbackQueries, err := e.buildResourceQueries(cr.query, &cr.azureMonitorData, resources, cr.startTime, cr.endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	series := []*tsdb.TimeSeries{}
+	for _, fq := range fallbackQueries {
+		queryRes, resp, err := e.executeQuery(ctx, fq, []*tsdb.Query{cr.query}, timeRange)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.parseResponse(queryRes, resp, fq); err != nil {
+			return nil, err
+		}
+		series = append(series, queryRes.Series...)
+	}
+
+	return series, nil
+}
+
+// groupResourcesForBatching buckets resources that share a subscription,
+// metric definition, region and time grain so each bucket can be fetched
+// with a single metrics:getBatch call.
+func groupResourcesForBatching(resources []resource, timeGrain string) []*batchResourceGroup {
+	groups := map[string]*batchResourceGroup{}
+	order := []string{}
+
+	for _, res := range resources {
+		key := strings.Join([]string{res.SubscriptionID, res.Type, res.Location, timeGrain}, "|")
+
+		group, ok := groups[key]
+		if !ok {
+			group = &batchResourceGroup{
+				Subscription:     res.SubscriptionID,
+				MetricDefinition: res.Type,
+				Location:         res.Location,
+				TimeGrain:        timeGrain,
+			}
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.Resources = append(group.Resources, res)
+	}
+
+	result := make([]*batchResourceGroup, 0, len(order))
+	for _, key := range order {
+		result = append(result, groups[key])
+	}
+	return result
+}
+
+// chunkResources splits resources into slices of at most size, since
+// Azure Monitor caps the number of resourceIds per metrics:getBatch call.
+func chunkResources(resources []resource, size int) [][]resource {
+	chunks := [][]resource{}
+	for size < len(resources) {
+		resources, chunks = resources[size:], append(chunks, resources[0:size:size])
+	}
+	return append(chunks, resources)
+}
+
+// batchMetricsResponse is the batched equivalent of AzureMonitorResponse:
+// a values array where each entry carries the resource it belongs to
+// alongside the same timeseries shape as the single-resource API.
+type batchMetricsResponse struct {
+	Values []struct {
+		ResourceID string             `json:"resourceid"`
+		Value      []batchMetricValue `json:"value"`
+	} `json:"values"`
+}
+
+type batchMetricValue struct {
+	ID         string                 `json:"id"`
+	Namespace  string                 `json:"namespace"`
+	Name       batchLocalizableString `json:"name"`
+	Unit       string                 `json:"unit"`
+	Timeseries []batchTimeseries      `json:"timeseries"`
+}
+
+type batchLocalizableString struct {
+	Value          string `json:"value"`
+	LocalizedValue string `json:"localizedValue"`
+}
+
+type batchTimeseries struct {
+	Metadatavalues []struct {
+		Name  batchLocalizableString `json:"name"`
+		Value string                 `json:"value"`
+	} `json:"metadatavalues"`
+	Data []struct {
+		TimeStamp time.Time `json:"timeStamp"`
+		Average   float64   `json:"average"`
+		Total     float64   `json:"total"`
+		Maximum   float64   `json:"maximum"`
+		Minimum   float64   `json:"minimum"`
+		Count     float64   `json:"count"`
+	} `json:"data"`
+}
+
+// executeBatchGroupQuery issues a single metrics:getBatch POST for a
+// chunk of same-group resources and demultiplexes the response back into
+// one tsdb.TimeSeries per resource/dimension combination.
+func (e *AzureMonitorDatasource) executeBatchGroupQuery(ctx context.Context, cr *crossResourceQuery, group *batchResourceGroup, resources []resource, timeGrain string) ([]*tsdb.TimeSeries, error) {
+	azureMonitorData := cr.azureMonitorData
+
+	params := url.Values{}
+	params.Add("api-version", metricsGetBatchAPIVersion)
+	params.Add("timespan", fmt.Sprintf("%v/%v", cr.startTime.UTC().Format(time.RFC3339), cr.endTime.UTC().Format(time.RFC3339)))
+	params.Add("interval", timeGrain)
+	params.Add("aggregation", azureMonitorData.Aggregation)
+	params.Add("metricnames", azureMonitorData.MetricName)
+	if azureMonitorData.MetricNamespace != "" {
+		params.Add("metricnamespace", azureMonitorData.MetricNamespace)
+	}
+
+	dimension := strings.TrimSpace(azureMonitorData.Dimension)
+	dimensionFilter := strings.TrimSpace(azureMonitorData.DimensionFilter)
+	if len(dimension) > 0 && len(dimensionFilter) > 0 && dimension != "None" {
+		params.Add("$filter", fmt.Sprintf("%s eq '%s'", dimension, dimensionFilter))
+	}
+
+	resourceIDs := make([]string, len(resources))
+	for i, res := range resources {
+		resourceIDs[i] = res.ID
+	}
+
+	body, err := json.Marshal(struct {
+		ResourceIDs []string `json:"resourceids"`
+	}{ResourceIDs: resourceIDs})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := e.createRequest(ctx, e.dsInfo)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = http.MethodPost
+	req.URL.Path = path.Join(req.URL.Path, group.Subscription, "providers/Microsoft.Insights/metrics:getBatch")
+	req.URL.RawQuery = params.Encode()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	azlog.Debug("AzureMonitor", "Batch request URL", req.URL.String())
+	res, err := ctxhttp.Do(ctx, e.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	respBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode/100 != 2 {
+		return nil, &batchRequestError{StatusCode: res.StatusCode, Body: string(respBody)}
+	}
+
+	var data batchMetricsResponse
+	if err := json.Unmarshal(respBody, &data); err != nil {
+		azlog.Error("Failed to unmarshal metrics:getBatch response", "error", err, "status", res.Status, "body", string(respBody))
+		return nil, err
+	}
+
+	return demuxBatchResponse(data, resources, azureMonitorData.Alias, azureMonitorData.Aggregation), nil
+}
+
+// demuxBatchResponse splits a metrics:getBatch response, which groups
+// values by resourceid, back into one tsdb.TimeSeries per
+// resource/dimension combination, named the same way a non-batched query
+// would name it.
+func demuxBatchResponse(data batchMetricsResponse, resources []resource, alias, aggregation string) []*tsdb.TimeSeries {
+	resourceNames := map[string]string{}
+	for _, res := range resources {
+		resourceNames[res.ID] = res.Name
+	}
+
+	series := []*tsdb.TimeSeries{}
+	for _, value := range data.Values {
+		if len(value.Value) == 0 {
+			continue
+		}
+		metric := value.Value[0]
+
+		for _, ts := range metric.Timeseries {
+			points := []tsdb.TimePoint{}
+
+			metadataName := ""
+			metadataValue := ""
+			if len(ts.Metadatavalues) > 0 {
+				metadataName = ts.Metadatavalues[0].Name.LocalizedValue
+				metadataValue = ts.Metadatavalues[0].Value
+			}
+
+			resourceName := resourceNames[value.ResourceID]
+			metricName := formatLegendKey(alias, resourceName, metric.Name.LocalizedValue, metadataName, metadataValue, metric.Namespace, metric.ID)
+
+			for _, point := range ts.Data {
+				var v float64
+				switch aggregation {
+				case "Average":
+					v = point.Average
+				case "Total":
+					v = point.Total
+				case "Maximum":
+					v = point.Maximum
+				case "Minimum":
+					v = point.Minimum
+				case "Count":
+					v = point.Count
+				default:
+					v = point.Count
+				}
+				points = append(points, tsdb.NewTimePoint(null.FloatFrom(v), float64(point.TimeStamp.Unix())*1000))
+			}
+
+			series = append(series, &tsdb.TimeSeries{
+				Name:   metricName,
+				Points: points,
+			})
+		}
+	}
+
+	return series
+}
@@ -0,0 +1,183 @@
+package azuremonitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDemuxBatchResponse(t *testing.T) {
+	resources := []resource{
+		{ID: "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", Name: "vm1"},
+		{ID: "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", Name: "vm2"},
+	}
+
+	now := time.Date(2026, 7, 27, 0, 0, 0, 0, time.UTC)
+	data := batchMetricsResponse{
+		Values: []struct {
+			ResourceID string             `json:"resourceid"`
+			Value      []batchMetricValue `json:"value"`
+		}{
+			{
+				ResourceID: resources[0].ID,
+				Value: []batchMetricValue{
+					{
+						Name: batchLocalizableString{Value: "Percentage CPU", LocalizedValue: "Percentage CPU"},
+						Timeseries: []batchTimeseries{
+							{
+								Data: []struct {
+									TimeStamp time.Time `json:"timeStamp"`
+									Average   float64   `json:"average"`
+									Total     float64   `json:"total"`
+									Maximum   float64   `json:"maximum"`
+									Minimum   float64   `json:"minimum"`
+									Count     float64   `json:"count"`
+								}{
+									{TimeStamp: now, Average: 12.5},
+									{TimeStamp: now.Add(time.Minute), Average: 20},
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				ResourceID: resources[1].ID,
+				Value: []batchMetricValue{
+					{
+						Name: batchLocalizableString{Value: "Percentage CPU", LocalizedValue: "Percentage CPU"},
+						Timeseries: []batchTimeseries{
+							{
+								Data: []struct {
+									TimeStamp time.Time `json:"timeStamp"`
+									Average   float64   `json:"average"`
+									Total     float64   `json:"total"`
+									Maximum   float64   `json:"maximum"`
+									Minimum   float64   `json:"minimum"`
+									Count     float64   `json:"count"`
+								}{
+									{TimeStamp: now, Average: 55},
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				// A resource with no metric values should be skipped, not panic.
+				ResourceID: "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm3",
+				Value:      nil,
+			},
+		},
+	}
+
+	series := demuxBatchResponse(data, resources, "", "Average")
+
+	require.Len(t, series, 2)
+	assert.Equal(t, "vm1.Percentage CPU", series[0].Name)
+	require.Len(t, series[0].Points, 2)
+	assert.Equal(t, 12.5, series[0].Points[0][0].Float64)
+	assert.Equal(t, 20.0, series[0].Points[1][0].Float64)
+
+	assert.Equal(t, "vm2.Percentage CPU", series[1].Name)
+	require.Len(t, series[1].Points, 1)
+	assert.Equal(t, 55.0, series[1].Points[0][0].Float64)
+}
+
+func TestDemuxBatchResponseWithDimension(t *testing.T) {
+	resources := []resource{
+		{ID: "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", Name: "vm1"},
+	}
+
+	data := batchMetricsResponse{
+		Values: []struct {
+			ResourceID string             `json:"resourceid"`
+			Value      []batchMetricValue `json:"value"`
+		}{
+			{
+				ResourceID: resources[0].ID,
+				Value: []batchMetricValue{
+					{
+						Name: batchLocalizableString{LocalizedValue: "Percentage CPU"},
+						Timeseries: []batchTimeseries{
+							{
+								Metadatavalues: []struct {
+									Name  batchLocalizableString `json:"name"`
+									Value string                 `json:"value"`
+								}{
+									{Name: batchLocalizableString{LocalizedValue: "VmName"}, Value: "vm1"},
+								},
+								Data: []struct {
+									TimeStamp time.Time `json:"timeStamp"`
+									Average   float64   `json:"average"`
+									Total     float64   `json:"total"`
+									Maximum   float64   `json:"maximum"`
+									Minimum   float64   `json:"minimum"`
+									Count     float64   `json:"count"`
+								}{
+									{TimeStamp: time.Unix(0, 0).UTC(), Total: 7},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	series := demuxBatchResponse(data, resources, "", "Total")
+
+	require.Len(t, series, 1)
+	assert.Equal(t, "vm1{VmName=vm1}.Percentage CPU", series[0].Name)
+	assert.Equal(t, 7.0, series[0].Points[0][0].Float64)
+}
+
+func TestChunkResources(t *testing.T) {
+	resources := make([]resource, 5)
+	for i := range resources {
+		resources[i] = resource{ID: string(rune('a' + i))}
+	}
+
+	chunks := chunkResources(resources, 2)
+
+	require.Len(t, chunks, 3)
+	assert.Len(t, chunks[0], 2)
+	assert.Len(t, chunks[1], 2)
+	assert.Len(t, chunks[2], 1)
+}
+
+func TestChunkResourcesFitsInOneChunk(t *testing.T) {
+	resources := []resource{{ID: "a"}, {ID: "b"}}
+
+	chunks := chunkResources(resources, 50)
+
+	require.Len(t, chunks, 1)
+	assert.Len(t, chunks[0], 2)
+}
+
+func TestGroupResourcesForBatching(t *testing.T) {
+	resources := []resource{
+		{SubscriptionID: "sub1", Type: "Microsoft.Compute/virtualMachines", Location: "eastus"},
+		{SubscriptionID: "sub1", Type: "Microsoft.Compute/virtualMachines", Location: "eastus"},
+		{SubscriptionID: "sub1", Type: "Microsoft.Compute/virtualMachines", Location: "westus"},
+		{SubscriptionID: "sub2", Type: "Microsoft.Compute/virtualMachines", Location: "eastus"},
+	}
+
+	groups := groupResourcesForBatching(resources, "PT1M")
+
+	require.Len(t, groups, 3)
+	assert.Len(t, groups[0].Resources, 2)
+	assert.Equal(t, "eastus", groups[0].Location)
+	assert.Len(t, groups[1].Resources, 1)
+	assert.Equal(t, "westus", groups[1].Location)
+	assert.Len(t, groups[2].Resources, 1)
+	assert.Equal(t, "sub2", groups[2].Subscription)
+}
+
+func TestIsBatchClientError(t *testing.T) {
+	assert.True(t, isBatchClientError(&batchRequestError{StatusCode: 400}))
+	assert.False(t, isBatchClientError(&batchRequestError{StatusCode: 500}))
+	assert.False(t, isBatchClientError(assert.AnError))
+}
@@ -0,0 +1,490 @@
+package azuremonitor
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/tsdb"
+)
+
+const (
+	// aggregationCacheRetention is the default for how long cached
+	// buckets are kept before being expired, regardless of how often
+	// they're read; overridable per-datasource via the
+	// "aggregationCacheRetentionHours" JsonData setting.
+	aggregationCacheRetention = 24 * time.Hour
+
+	// aggregationCacheMaxSeries bounds the number of distinct series the
+	// aggregation cache holds before evicting the least recently used one.
+	aggregationCacheMaxSeries = 5000
+
+	// aggregationBucketSize is the bucket granularity used when a
+	// query's own time grain can't be determined, e.g. before its first
+	// successful fetch.
+	aggregationBucketSize = time.Minute
+)
+
+// aggregate is a rolling (min, max, sum, count) tuple for one cached time
+// bucket of a metric, mirroring the aggregate struct in the Telegraf
+// Azure Monitor output plugin.
+type aggregate struct {
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count float64
+}
+
+func (a *aggregate) add(value float64) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	a.Sum += value
+	a.Count++
+}
+
+func (a *aggregate) value(aggregation string) float64 {
+	switch aggregation {
+	case "Total":
+		return a.Sum
+	case "Maximum":
+		return a.Max
+	case "Minimum":
+		return a.Min
+	case "Average":
+		if a.Count == 0 {
+			return 0
+		}
+		return a.Sum / a.Count
+	default:
+		return a.Count
+	}
+}
+
+// seriesCacheKey identifies one cached series: the same dimensions Azure
+// Monitor itself partitions metrics by, plus the aggregation and time
+// grain a query asked for, since a bucket's tuple is only comparable
+// across queries that share all of them. DatasourceID and OrgID scope the
+// key to the datasource instance a query ran against, since defaultAggregationCache
+// is a single process-wide cache shared by every organization and every
+// Azure Monitor datasource configured in it. SeriesName distinguishes the
+// distinct per-dimension series a single query can return, so e.g. two
+// VMs' CPU series grouped by the same query are never aggregated
+// together under one bucket.
+type seriesCacheKey struct {
+	DatasourceID    int64
+	OrgID           int64
+	Subscription    string
+	ResourceID      string
+	MetricNamespace string
+	MetricName      string
+	Aggregation     string
+	DimensionFilter string
+	TimeGrain       string
+	SeriesName      string
+}
+
+// seriesCacheEntry holds the cached buckets for one series, keyed by
+// bucket start time (unix seconds, truncated to the series' own time
+// grain — see timeGrainDuration).
+type seriesCacheEntry struct {
+	buckets map[int64]*aggregate
+}
+
+type seriesCacheItem struct {
+	key   seriesCacheKey
+	entry *seriesCacheEntry
+}
+
+// timeWindow is a half-open [From, To) time range.
+type timeWindow struct {
+	From time.Time
+	To   time.Time
+}
+
+// aggregationCache is an in-process, LRU-bounded cache of time-bucketed
+// aggregates sitting in front of executeQuery. Dashboards refreshed by
+// many users end up re-requesting the same metric over mostly-overlapping
+// time ranges; this lets Grafana serve the buckets it has already
+// fetched and only ask Azure Monitor for the gap.
+type aggregationCache struct {
+	mu    sync.Mutex
+	items map[seriesCacheKey]*list.Element
+	lru   *list.List
+
+	// seriesByQuery tracks, for a query's placeholder key (SeriesName
+	// unset), every distinct series' name that query has ever produced,
+	// so a later call with nothing new to fetch can still re-emit every
+	// dimension it previously cached instead of only the ones refreshed
+	// this call.
+	seriesByQuery map[seriesCacheKey]map[string]bool
+
+	maxSeries int
+}
+
+func newAggregationCache() *aggregationCache {
+	return &aggregationCache{
+		items:         map[seriesCacheKey]*list.Element{},
+		lru:           list.New(),
+		seriesByQuery: map[seriesCacheKey]map[string]bool{},
+		maxSeries:     aggregationCacheMaxSeries,
+	}
+}
+
+var defaultAggregationCache = newAggregationCache()
+
+func bucketKey(t time.Time, grain time.Duration) int64 {
+	return t.Truncate(grain).Unix()
+}
+
+// timeGrainDuration parses the ISO8601 duration a query's "interval"
+// param was built from (e.g. "PT5M", "PT1H", "P1D") into the
+// corresponding Go duration, so cache buckets line up with the actual
+// boundaries Azure Monitor returns points on instead of an unrelated
+// fixed size. Falls back to aggregationBucketSize for an empty or
+// unparseable grain (e.g. before a query's first successful fetch).
+func timeGrainDuration(interval string) time.Duration {
+	d, err := parseISO8601Duration(interval)
+	if err != nil || d <= 0 {
+		return aggregationBucketSize
+	}
+	return d
+}
+
+// parseISO8601Duration parses the restricted subset of ISO8601 durations
+// Azure Monitor time grains use: an optional "P<n>D" date part and/or a
+// "T<n>H|<n>M|<n>S" time part.
+func parseISO8601Duration(s string) (time.Duration, error) {
+	if len(s) == 0 || s[0] != 'P' {
+		return 0, fmt.Errorf("not an ISO8601 duration: %q", s)
+	}
+	s = s[1:]
+
+	datePart, timePart := s, ""
+	if idx := strings.Index(s, "T"); idx >= 0 {
+		datePart, timePart = s[:idx], s[idx+1:]
+	}
+
+	var total time.Duration
+
+	if datePart != "" {
+		n, unit, err := splitISO8601Component(datePart)
+		if err != nil {
+			return 0, err
+		}
+		if unit != "D" {
+			return 0, fmt.Errorf("unsupported ISO8601 date unit: %q", unit)
+		}
+		total += time.Duration(n) * 24 * time.Hour
+	}
+
+	if timePart != "" {
+		n, unit, err := splitISO8601Component(timePart)
+		if err != nil {
+			return 0, err
+		}
+		switch unit {
+		case "H":
+			total += time.Duration(n) * time.Hour
+		case "M":
+			total += time.Duration(n) * time.Minute
+		case "S":
+			total += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("unsupported ISO8601 time unit: %q", unit)
+		}
+	}
+
+	return total, nil
+}
+
+// splitISO8601Component splits a "<n><unit>" ISO8601 component (e.g.
+// "5M") into its integer count and single-letter unit.
+func splitISO8601Component(s string) (int, string, error) {
+	if len(s) < 2 {
+		return 0, "", fmt.Errorf("malformed ISO8601 component: %q", s)
+	}
+	unit := s[len(s)-1:]
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return 0, "", err
+	}
+	return n, unit, nil
+}
+
+// missingRanges returns the [from, to) sub-ranges of [start, end] that
+// aren't already covered by cached buckets for key, bucketed at key's own
+// resolved time grain.
+func (c *aggregationCache) missingRanges(key seriesCacheKey, start, end time.Time) []timeWindow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	grain := timeGrainDuration(key.TimeGrain)
+
+	el, ok := c.items[key]
+	if !ok {
+		return []timeWindow{{From: start, To: end}}
+	}
+	c.lru.MoveToFront(el)
+	entry := el.Value.(*seriesCacheItem).entry
+
+	ranges := []timeWindow{}
+	var gapStart *time.Time
+
+	for t := start; t.Before(end); t = t.Add(grain) {
+		if _, cached := entry.buckets[bucketKey(t, grain)]; cached {
+			if gapStart != nil {
+				ranges = append(ranges, timeWindow{From: *gapStart, To: t})
+				gapStart = nil
+			}
+			continue
+		}
+		if gapStart == nil {
+			g := t
+			gapStart = &g
+		}
+	}
+	if gapStart != nil {
+		ranges = append(ranges, timeWindow{From: *gapStart, To: end})
+	}
+
+	return ranges
+}
+
+// mergeTimeWindows sorts and coalesces overlapping or adjacent windows,
+// so gaps independently detected for several series of the same query
+// can be fetched with the fewest possible requests.
+func mergeTimeWindows(windows []timeWindow) []timeWindow {
+	if len(windows) == 0 {
+		return windows
+	}
+
+	sorted := make([]timeWindow, len(windows))
+	copy(sorted, windows)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].From.Before(sorted[j].From) })
+
+	merged := []timeWindow{sorted[0]}
+	for _, w := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if w.From.After(last.To) {
+			merged = append(merged, w)
+			continue
+		}
+		if w.To.After(last.To) {
+			last.To = w.To
+		}
+	}
+
+	return merged
+}
+
+// seriesPoints returns the cached points for key across [start, end],
+// rendered with the aggregation the key was stored for.
+func (c *aggregationCache) seriesPoints(key seriesCacheKey, start, end time.Time) []tsdb.TimePoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	entry := el.Value.(*seriesCacheItem).entry
+
+	points := []tsdb.TimePoint{}
+	for b, agg := range entry.buckets {
+		t := time.Unix(b, 0)
+		if t.Before(start) || t.After(end) {
+			continue
+		}
+		points = append(points, tsdb.NewTimePoint(null.FloatFrom(agg.value(key.Aggregation)), float64(b)*1000))
+	}
+
+	return points
+}
+
+// seriesNames returns the full cache key for every distinct series the
+// query identified by placeholder (a key with SeriesName unset) has ever
+// populated, so callers can re-emit series that weren't refreshed on this
+// particular call because their range was already fully cached.
+func (c *aggregationCache) seriesNames(placeholder seriesCacheKey) map[seriesCacheKey]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := map[seriesCacheKey]bool{}
+	for name := range c.seriesByQuery[placeholder] {
+		key := placeholder
+		key.SeriesName = name
+		keys[key] = true
+	}
+	return keys
+}
+
+// merge folds freshly-fetched points into the cache for key, bucketed at
+// key's own resolved time grain, evicting the least recently used series
+// if the cache has grown past its size cap, then expires this series'
+// buckets older than retention. Other series' buckets are only expired
+// when they are themselves merged into.
+func (c *aggregationCache) merge(key seriesCacheKey, points []tsdb.TimePoint, retention time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	grain := timeGrainDuration(key.TimeGrain)
+
+	placeholder := key
+	placeholder.SeriesName = ""
+	names, ok := c.seriesByQuery[placeholder]
+	if !ok {
+		names = map[string]bool{}
+		c.seriesByQuery[placeholder] = names
+	}
+	names[key.SeriesName] = true
+
+	el, ok := c.items[key]
+	var entry *seriesCacheEntry
+	if ok {
+		entry = el.Value.(*seriesCacheItem).entry
+		c.lru.MoveToFront(el)
+	} else {
+		entry = &seriesCacheEntry{buckets: map[int64]*aggregate{}}
+		el = c.lru.PushFront(&seriesCacheItem{key: key, entry: entry})
+		c.items[key] = el
+
+		for c.lru.Len() > c.maxSeries {
+			oldest := c.lru.Back()
+			if oldest == nil {
+				break
+			}
+			c.lru.Remove(oldest)
+			delete(c.items, oldest.Value.(*seriesCacheItem).key)
+		}
+	}
+
+	for _, p := range points {
+		if !p[0].Valid || !p[1].Valid {
+			continue
+		}
+		bucket := bucketKey(time.Unix(int64(p[1].Float64)/1000, 0), grain)
+		agg, ok := entry.buckets[bucket]
+		if !ok {
+			agg = &aggregate{}
+			entry.buckets[bucket] = agg
+		}
+		agg.add(p[0].Float64)
+	}
+
+	cutoff := time.Now().Add(-retention).Unix()
+	for b := range entry.buckets {
+		if b < cutoff {
+			delete(entry.buckets, b)
+		}
+	}
+}
+
+// cacheKeyForQuery builds the aggregation cache key for one distinct
+// series of a single-resource AzureMonitorQuery, using the same
+// dimensions the query itself was built from plus the series' own final
+// name (as parseResponse renders it, metadata and all), so that distinct
+// per-dimension series returned for the same query are never merged into
+// one bucket, and a key is never reused across datasources or
+// organizations sharing this process-wide cache.
+func cacheKeyForQuery(e *AzureMonitorDatasource, query *AzureMonitorQuery, seriesName string) seriesCacheKey {
+	return seriesCacheKey{
+		DatasourceID:    e.dsInfo.Id,
+		OrgID:           e.dsInfo.OrgId,
+		Subscription:    query.UrlComponents["subscription"],
+		ResourceID:      query.URL,
+		MetricNamespace: query.Params.Get("metricnamespace"),
+		MetricName:      query.Params.Get("metricnames"),
+		Aggregation:     query.Params.Get("aggregation"),
+		DimensionFilter: query.Params.Get("$filter"),
+		TimeGrain:       query.Params.Get("interval"),
+		SeriesName:      seriesName,
+	}
+}
+
+// executeQueryCached wraps executeQuery/parseResponse with the
+// aggregation cache: it only asks Azure Monitor for the portion of
+// [startTime, endTime] that isn't already cached, merges each fetched
+// series into its own cache entry keyed by its rendered name so that
+// distinct dimensions never collide, then returns the full requested
+// range from cache, one series per cached entry this query has ever
+// populated that has points in that range.
+func (e *AzureMonitorDatasource) executeQueryCached(ctx context.Context, query *AzureMonitorQuery, queries []*tsdb.Query, timeRange *tsdb.TimeRange, startTime, endTime time.Time) (*tsdb.QueryResult, error) {
+	// Until the first fetch comes back we don't yet know the set of
+	// dimension series this query produces, so there's nothing cached to
+	// find gaps against yet: fetch the whole requested range. Once we do
+	// know them, each series can have fallen behind by a different
+	// amount (e.g. one dimension appeared partway through an earlier
+	// range), so every known series' own gaps are unioned into the
+	// fewest requests that cover all of them, rather than trusting one
+	// arbitrary series to speak for the rest.
+	placeholderKey := cacheKeyForQuery(e, query, "")
+	seriesKeys := defaultAggregationCache.seriesNames(placeholderKey)
+
+	var missing []timeWindow
+	if len(seriesKeys) == 0 {
+		missing = []timeWindow{{From: startTime, To: endTime}}
+	} else {
+		for key := range seriesKeys {
+			missing = append(missing, defaultAggregationCache.missingRanges(key, startTime, endTime)...)
+		}
+		missing = mergeTimeWindows(missing)
+	}
+
+	retention := time.Duration(e.dsInfo.JsonData.Get("aggregationCacheRetentionHours").MustInt(int(aggregationCacheRetention/time.Hour))) * time.Hour
+
+	var gapErr error
+
+	for _, window := range missing {
+		gapQuery := *query
+		gapParams := url.Values{}
+		for k, v := range query.Params {
+			gapParams[k] = v
+		}
+		gapParams.Set("timespan", fmt.Sprintf("%v/%v", window.From.UTC().Format(time.RFC3339), window.To.UTC().Format(time.RFC3339)))
+		gapQuery.Params = gapParams
+
+		gapRes, resp, err := e.executeQuery(ctx, &gapQuery, queries, timeRange)
+		if err != nil {
+			return nil, err
+		}
+		if gapRes.Error != nil {
+			gapErr = gapRes.Error
+			continue
+		}
+		if err := e.parseResponse(gapRes, resp, &gapQuery); err != nil {
+			gapErr = err
+			continue
+		}
+		for _, series := range gapRes.Series {
+			key := cacheKeyForQuery(e, query, series.Name)
+			seriesKeys[key] = true
+			defaultAggregationCache.merge(key, series.Points, retention)
+		}
+	}
+
+	queryRes := &tsdb.QueryResult{RefId: query.RefID, Error: gapErr}
+	for key := range seriesKeys {
+		points := defaultAggregationCache.seriesPoints(key, startTime, endTime)
+		if len(points) == 0 {
+			continue
+		}
+		queryRes.Series = append(queryRes.Series, &tsdb.TimeSeries{
+			Name:   key.SeriesName,
+			Points: points,
+		})
+	}
+
+	return queryRes, nil
+}
@@ -0,0 +1,189 @@
+package azuremonitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/tsdb"
+)
+
+func TestAggregateValue(t *testing.T) {
+	a := &aggregate{}
+	a.add(10)
+	a.add(20)
+	a.add(30)
+
+	assert.Equal(t, 10.0, a.value("Minimum"))
+	assert.Equal(t, 30.0, a.value("Maximum"))
+	assert.Equal(t, 60.0, a.value("Total"))
+	assert.Equal(t, 20.0, a.value("Average"))
+	assert.Equal(t, 3.0, a.value("Count"))
+}
+
+func TestAggregateValueEmpty(t *testing.T) {
+	a := &aggregate{}
+	assert.Equal(t, 0.0, a.value("Average"))
+}
+
+func point(t time.Time, v float64) tsdb.TimePoint {
+	return tsdb.NewTimePoint(null.FloatFrom(v), float64(t.Unix())*1000)
+}
+
+func TestAggregationCacheMissingRangesOnEmptyCache(t *testing.T) {
+	c := newAggregationCache()
+	key := seriesCacheKey{MetricName: "Percentage CPU"}
+
+	start := time.Date(2026, 7, 27, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Minute)
+
+	ranges := c.missingRanges(key, start, end)
+
+	require.Len(t, ranges, 1)
+	assert.True(t, ranges[0].From.Equal(start))
+	assert.True(t, ranges[0].To.Equal(end))
+}
+
+func TestAggregationCacheMergeAndSeriesPoints(t *testing.T) {
+	c := newAggregationCache()
+	key := seriesCacheKey{MetricName: "Percentage CPU", Aggregation: "Average"}
+
+	// Recent enough that merge's retention cutoff keeps the buckets.
+	start := time.Now().UTC().Truncate(time.Hour)
+	c.merge(key, []tsdb.TimePoint{
+		point(start, 10),
+		point(start.Add(time.Minute), 20),
+	}, aggregationCacheRetention)
+
+	points := c.seriesPoints(key, start, start.Add(2*time.Minute))
+	require.Len(t, points, 2)
+
+	// seriesPoints doesn't guarantee order, so check both values are present.
+	values := map[float64]bool{}
+	for _, p := range points {
+		values[p[0].Float64] = true
+	}
+	assert.True(t, values[10])
+	assert.True(t, values[20])
+}
+
+func TestAggregationCacheMissingRangesUsesQueryTimeGrain(t *testing.T) {
+	c := newAggregationCache()
+	key := seriesCacheKey{MetricName: "Percentage CPU", Aggregation: "Average", TimeGrain: "PT5M"}
+
+	// Hour-aligned, so also 5-minute aligned, and recent enough that
+	// merge's retention cutoff keeps the bucket.
+	start := time.Now().UTC().Truncate(time.Hour)
+	// Only the 5-minute bucket at `start` is cached; a 1-minute bucket
+	// size would see every other minute in [start, start+10m) as a gap.
+	c.merge(key, []tsdb.TimePoint{point(start.Add(2 * time.Minute), 10)}, aggregationCacheRetention)
+
+	ranges := c.missingRanges(key, start, start.Add(10*time.Minute))
+
+	require.Len(t, ranges, 1)
+	assert.True(t, ranges[0].From.Equal(start.Add(5*time.Minute)))
+	assert.True(t, ranges[0].To.Equal(start.Add(10*time.Minute)))
+}
+
+func TestParseISO8601Duration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"PT1M":  time.Minute,
+		"PT5M":  5 * time.Minute,
+		"PT1H":  time.Hour,
+		"P1D":   24 * time.Hour,
+		"PT30S": 30 * time.Second,
+	}
+	for s, want := range cases {
+		got, err := parseISO8601Duration(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+}
+
+func TestParseISO8601DurationRejectsUnparseable(t *testing.T) {
+	_, err := parseISO8601Duration("bogus")
+	assert.Error(t, err)
+}
+
+func TestMergeTimeWindowsCoalescesOverlappingAndAdjacent(t *testing.T) {
+	start := time.Date(2026, 7, 27, 0, 0, 0, 0, time.UTC)
+
+	merged := mergeTimeWindows([]timeWindow{
+		{From: start.Add(10 * time.Minute), To: start.Add(20 * time.Minute)},
+		{From: start, To: start.Add(10 * time.Minute)},
+		{From: start.Add(30 * time.Minute), To: start.Add(40 * time.Minute)},
+	})
+
+	require.Len(t, merged, 2)
+	assert.True(t, merged[0].From.Equal(start))
+	assert.True(t, merged[0].To.Equal(start.Add(20*time.Minute)))
+	assert.True(t, merged[1].From.Equal(start.Add(30*time.Minute)))
+	assert.True(t, merged[1].To.Equal(start.Add(40*time.Minute)))
+}
+
+func TestAggregationCacheMissingRangesAfterPartialMerge(t *testing.T) {
+	c := newAggregationCache()
+	key := seriesCacheKey{MetricName: "Percentage CPU", Aggregation: "Average"}
+
+	// Recent enough that merge's retention cutoff keeps the bucket.
+	start := time.Now().UTC().Truncate(time.Hour)
+	c.merge(key, []tsdb.TimePoint{point(start, 10)}, aggregationCacheRetention)
+
+	ranges := c.missingRanges(key, start, start.Add(3*time.Minute))
+
+	require.Len(t, ranges, 1)
+	assert.True(t, ranges[0].From.Equal(start.Add(time.Minute)))
+	assert.True(t, ranges[0].To.Equal(start.Add(3*time.Minute)))
+}
+
+func TestAggregationCacheMergeIgnoresInvalidPoints(t *testing.T) {
+	c := newAggregationCache()
+	key := seriesCacheKey{MetricName: "Percentage CPU", Aggregation: "Average"}
+
+	c.merge(key, []tsdb.TimePoint{{null.Float{}, null.Float{}}}, aggregationCacheRetention)
+
+	points := c.seriesPoints(key, time.Unix(0, 0), time.Now())
+	assert.Empty(t, points)
+}
+
+func TestAggregationCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newAggregationCache()
+	c.maxSeries = 2
+
+	k1 := seriesCacheKey{MetricName: "m1"}
+	k2 := seriesCacheKey{MetricName: "m2"}
+	k3 := seriesCacheKey{MetricName: "m3"}
+
+	now := time.Now()
+	c.merge(k1, []tsdb.TimePoint{point(now, 1)}, aggregationCacheRetention)
+	c.merge(k2, []tsdb.TimePoint{point(now, 1)}, aggregationCacheRetention)
+	c.merge(k3, []tsdb.TimePoint{point(now, 1)}, aggregationCacheRetention)
+
+	// k1 should have been evicted to make room for k3, since it was the
+	// least recently touched series once the cache hit maxSeries.
+	assert.Empty(t, c.seriesPoints(k1, now.Add(-time.Hour), now.Add(time.Hour)))
+	assert.NotEmpty(t, c.seriesPoints(k2, now.Add(-time.Hour), now.Add(time.Hour)))
+	assert.NotEmpty(t, c.seriesPoints(k3, now.Add(-time.Hour), now.Add(time.Hour)))
+}
+
+func TestAggregationCacheSeriesNamesTracksDistinctDimensions(t *testing.T) {
+	c := newAggregationCache()
+	placeholder := seriesCacheKey{MetricName: "Percentage CPU"}
+
+	vm1Key := placeholder
+	vm1Key.SeriesName = "vm1.Percentage CPU"
+	vm2Key := placeholder
+	vm2Key.SeriesName = "vm2.Percentage CPU"
+
+	now := time.Now()
+	c.merge(vm1Key, []tsdb.TimePoint{point(now, 1)}, aggregationCacheRetention)
+	c.merge(vm2Key, []tsdb.TimePoint{point(now, 2)}, aggregationCacheRetention)
+
+	names := c.seriesNames(placeholder)
+	require.Len(t, names, 2)
+	assert.True(t, names[vm1Key])
+	assert.True(t, names[vm2Key])
+}
@@ -45,21 +45,27 @@ func (e *AzureMonitorDatasource) executeTimeSeriesQuery(ctx context.Context, ori
 		Results: map[string]*tsdb.QueryResult{},
 	}
 
-	queries, err := e.buildQueries(ctx, originalQueries, timeRange)
+	startTime, err := timeRange.ParseFrom()
+	if err != nil {
+		return nil, err
+	}
+
+	endTime, err := timeRange.ParseTo()
+	if err != nil {
+		return nil, err
+	}
+
+	queries, crossResourceQueries, promQLQueries, err := e.buildQueries(ctx, originalQueries, timeRange)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, query := range queries {
-		queryRes, resp, err := e.executeQuery(ctx, query, originalQueries, timeRange)
+		queryRes, err := e.executeQueryCached(ctx, query, originalQueries, timeRange, startTime, endTime)
 		if err != nil {
 			return nil, err
 		}
 
-		err = e.parseResponse(queryRes, resp, query)
-		if err != nil {
-			queryRes.Error = err
-		}
 		if val, ok := result.Results[query.RefID]; ok {
 			val.Series = append(result.Results[query.RefID].Series, queryRes.Series...)
 		} else {
@@ -67,33 +73,64 @@ func (e *AzureMonitorDatasource) executeTimeSeriesQuery(ctx context.Context, ori
 		}
 	}
 
-	// Sort times series in evert query by name
-	for _, query := range queries {
-		sort.Slice(result.Results[query.RefID].Series, func(i, j int) bool {
-			return result.Results[query.RefID].Series[i].Name < result.Results[query.RefID].Series[j].Name
+	for _, crQuery := range crossResourceQueries {
+		queryRes, err := e.executeCrossResourceQuery(ctx, crQuery, timeRange)
+		if err != nil {
+			return nil, err
+		}
+		if val, ok := result.Results[queryRes.RefId]; ok {
+			val.Series = append(val.Series, queryRes.Series...)
+		} else {
+			result.Results[queryRes.RefId] = queryRes
+		}
+	}
+
+	for _, pq := range promQLQueries {
+		queryRes, err := e.executePromQLQuery(ctx, pq)
+		if err != nil {
+			return nil, err
+		}
+		if val, ok := result.Results[queryRes.RefId]; ok {
+			val.Series = append(val.Series, queryRes.Series...)
+		} else {
+			result.Results[queryRes.RefId] = queryRes
+		}
+	}
+
+	// Sort times series in every query by name
+	for _, queryRes := range result.Results {
+		sort.Slice(queryRes.Series, func(i, j int) bool {
+			return queryRes.Series[i].Name < queryRes.Series[j].Name
 		})
 	}
 
 	return result, nil
 }
 
-func (e *AzureMonitorDatasource) buildQueries(ctx context.Context, queries []*tsdb.Query, timeRange *tsdb.TimeRange) ([]*AzureMonitorQuery, error) {
+// buildQueries splits the incoming queries into the singleResource
+// AzureMonitorQueries that can go through the regular executeQuery path,
+// the crossResource queries, which are resolved separately through
+// executeCrossResourceQuery so they can be batched, and the promql
+// queries, which are evaluated through executePromQLQuery.
+func (e *AzureMonitorDatasource) buildQueries(ctx context.Context, queries []*tsdb.Query, timeRange *tsdb.TimeRange) ([]*AzureMonitorQuery, []*crossResourceQuery, []*promQLQuery, error) {
 	azureMonitorQueries := []*AzureMonitorQuery{}
+	crossResourceQueries := []*crossResourceQuery{}
+	promQLQueries := []*promQLQuery{}
 	startTime, err := timeRange.ParseFrom()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	endTime, err := timeRange.ParseTo()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	for _, query := range queries {
 		var azureMonitorTarget AzureMonitorQueryModel
 		data, err := query.Model.Get("azureMonitor").MarshalJSON()
 		if err != nil {
-			return nil, fmt.Errorf("Invalid query format")
+			return nil, nil, nil, fmt.Errorf("Invalid query format")
 		}
 		json.Unmarshal(data, &azureMonitorTarget)
 
@@ -109,20 +146,28 @@ func (e *AzureMonitorDatasource) buildQueries(ctx context.Context, queries []*ts
 		if azureMonitorTarget.QueryMode == "singleResource" {
 			azQuery, err := e.buildSingleQuery(query, &azureMonitorData, startTime, endTime, query.Model.Get("subscription").MustString())
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			azureMonitorQueries = append(azureMonitorQueries, &azQuery)
 		} else if azureMonitorTarget.QueryMode == "crossResource" {
-			azQueries, err := e.buildMultipleResourcesQueries(ctx, query, &azureMonitorData, startTime, endTime)
-			if err != nil {
-				return nil, err
-			}
-			azureMonitorQueries = append(azureMonitorQueries, azQueries...)
+			crossResourceQueries = append(crossResourceQueries, &crossResourceQuery{
+				query:            query,
+				azureMonitorData: azureMonitorData,
+				startTime:        startTime,
+				endTime:          endTime,
+			})
+		} else if azureMonitorTarget.QueryMode == "promql" {
+			promQLQueries = append(promQLQueries, &promQLQuery{
+				query:     query,
+				data:      azureMonitorData,
+				startTime: startTime,
+				endTime:   endTime,
+			})
 		}
 
 	}
 
-	return azureMonitorQueries, nil
+	return azureMonitorQueries, crossResourceQueries, promQLQueries, nil
 }
 
 func (e *AzureMonitorDatasource) buildSingleQuery(query *tsdb.Query, azureMonitorData *AzureMonitorData, startTime time.Time, endTime time.Time, subscriptionID string) (AzureMonitorQuery, error) {
@@ -143,14 +188,9 @@ func (e *AzureMonitorDatasource) buildSingleQuery(query *tsdb.Query, azureMonito
 	}
 	azureURL := ub.Build()
 
-	timeGrain := azureMonitorData.TimeGrain
-	timeGrains := azureMonitorData.AllowedTimeGrainsMs
-	var err error
-	if timeGrain == "auto" {
-		timeGrain, err = e.setAutoTimeGrain(query.IntervalMs, timeGrains)
-		if err != nil {
-			return AzureMonitorQuery{}, err
-		}
+	timeGrain, err := e.resolveTimeGrain(query.IntervalMs, azureMonitorData)
+	if err != nil {
+		return AzureMonitorQuery{}, err
 	}
 
 	params := url.Values{}
@@ -186,22 +226,19 @@ func (e *AzureMonitorDatasource) buildSingleQuery(query *tsdb.Query, azureMonito
 	}, nil
 }
 
-func (e *AzureMonitorDatasource) buildMultipleResourcesQueries(ctx context.Context, query *tsdb.Query, azureMonitorData *AzureMonitorData, startTime time.Time, endTime time.Time) ([]*AzureMonitorQuery, error) {
+// buildResourceQueries builds one AzureMonitorQuery per resource. It backs
+// the per-resource fallback used when a batched metrics:getBatch request
+// is rejected by Azure Monitor, and promql queries that span resources.
+func (e *AzureMonitorDatasource) buildResourceQueries(query *tsdb.Query, azureMonitorData *AzureMonitorData, resources []resource, startTime time.Time, endTime time.Time) ([]*AzureMonitorQuery, error) {
 	azureMonitorQueries := []*AzureMonitorQuery{}
-	subscriptions := query.Model.Get("subscriptions").MustArray()
-
-	resources, err := e.getResources(ctx, azureMonitorData, subscriptions)
-	if err != nil {
-		return azureMonitorQueries, err
-	}
 
-	for _, resource := range resources {
+	for _, res := range resources {
 		data := azureMonitorData
-		data.ResourceGroup = resource.ParseGroup()
-		data.MetricDefinition = resource.Type
-		data.ResourceName = resource.Name
+		data.ResourceGroup = res.ParseGroup()
+		data.MetricDefinition = res.Type
+		data.ResourceName = res.Name
 
-		azQuery, err := e.buildSingleQuery(query, data, startTime, endTime, resource.SubscriptionID)
+		azQuery, err := e.buildSingleQuery(query, data, startTime, endTime, res.SubscriptionID)
 		if err != nil {
 			return nil, err
 		}
@@ -211,40 +248,14 @@ func (e *AzureMonitorDatasource) buildMultipleResourcesQueries(ctx context.Conte
 	return azureMonitorQueries, nil
 }
 
-func (e *AzureMonitorDatasource) getResources(ctx context.Context, azureMonitorData *AzureMonitorData, subscriptions []interface{}) ([]resource, error) {
-	resourcesMap := map[string]resource{}
-
-	for _, subscriptionID := range subscriptions {
-		resourcesResponse, err := e.executeResourcesQuery(ctx, fmt.Sprintf("%v", subscriptionID))
-		if err != nil {
-			return []resource{}, err
-		}
-
-		for _, resourceResponse := range resourcesResponse.Value {
-			resource := resource{
-				ID:             resourceResponse.ID,
-				Name:           resourceResponse.Name,
-				Type:           resourceResponse.Type,
-				Location:       resourceResponse.Location,
-				SubscriptionID: fmt.Sprintf("%v", subscriptionID),
-			}
-
-			match := contains(azureMonitorData.ResourceGroups, resource.ParseGroup()) &&
-				contains(azureMonitorData.Locations, resource.Location) &&
-				azureMonitorData.MetricDefinition == resource.Type
-
-			if _, ok := resourcesMap[resource.GetKey()]; !ok && match {
-				resourcesMap[resource.GetKey()] = resource
-			}
-		}
+// resolveTimeGrain returns the time grain to query with, resolving the
+// "auto" time grain to the closest one allowed for the metric based on
+// the query's requested interval.
+func (e *AzureMonitorDatasource) resolveTimeGrain(intervalMs int64, azureMonitorData *AzureMonitorData) (string, error) {
+	if azureMonitorData.TimeGrain != "auto" {
+		return azureMonitorData.TimeGrain, nil
 	}
-
-	resources := []resource{}
-	for _, resource := range resourcesMap {
-		resources = append(resources, resource)
-	}
-
-	return resources, nil
+	return e.setAutoTimeGrain(intervalMs, azureMonitorData.AllowedTimeGrainsMs)
 }
 
 // setAutoTimeGrain tries to find the closest interval to the query's intervalMs value
@@ -305,29 +316,6 @@ func (e *AzureMonitorDatasource) executeQuery(ctx context.Context, query *AzureM
 	return queryResult, data, nil
 }
 
-func (e *AzureMonitorDatasource) executeResourcesQuery(ctx context.Context, subscriptionID string) (ResourcesResponse, error) {
-	req, err := e.createRequest(ctx, e.dsInfo)
-	if err != nil {
-		return ResourcesResponse{}, err
-	}
-
-	params := url.Values{}
-	params.Add("api-version", "2018-01-01")
-	req.URL.Path = path.Join(req.URL.Path, subscriptionID, "resources")
-	req.URL.RawQuery = params.Encode()
-
-	res, err := ctxhttp.Do(ctx, e.httpClient, req)
-	if err != nil {
-		return ResourcesResponse{}, err
-	}
-	data, err := e.unmarshalResourcesResponse(res)
-	if err != nil {
-		return ResourcesResponse{}, err
-	}
-
-	return data, nil
-}
-
 func (e *AzureMonitorDatasource) createRequest(ctx context.Context, dsInfo *models.DataSource) (*http.Request, error) {
 	// find plugin
 	plugin, ok := plugins.DataSources[dsInfo.Type]
@@ -359,6 +347,20 @@ func (e *AzureMonitorDatasource) createRequest(ctx context.Context, dsInfo *mode
 	req.Header.Set("User-Agent", fmt.Sprintf("Grafana/%s", setting.BuildVersion))
 
 	pluginproxy.ApplyRoute(ctx, req, proxyPass, azureMonitorRoute, dsInfo)
+
+	if dsInfo.JsonData.Get("authType").MustString() == "msi" {
+		clientID := dsInfo.JsonData.Get("clientId").MustString()
+		token, err := e.getMSIAccessToken(ctx, clientID, managementResourceForCloud(cloudName))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to acquire MSI access token. error: %v", err)
+		}
+		// ApplyRoute already rewrote req.URL to the real Azure Monitor
+		// endpoint and set whatever Authorization header the route's
+		// client-credentials config would use; MSI replaces that header
+		// with the token IMDS gave us, but keeps the rewritten URL.
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
 	return req, nil
 }
 
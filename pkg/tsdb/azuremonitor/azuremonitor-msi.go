@@ -0,0 +1,161 @@
+package azuremonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	imdsAPIVersion    = "2018-02-01"
+
+	// defaultMSITokenExpiryWatermarkMinutes is how long before a token's
+	// actual expiry we treat it as stale and fetch a replacement, so a
+	// request is never built with a token that expires mid-flight. It
+	// can be overridden per-datasource via the
+	// "msiTokenExpiryWatermarkMinutes" JsonData setting.
+	defaultMSITokenExpiryWatermarkMinutes = 5
+)
+
+// managementResourceByCloud maps the same "cloudName" JsonData setting
+// createRequest uses to build the proxy pass onto the ARM audience an MSI
+// token must be requested for in that sovereign cloud; the public cloud
+// management endpoint is wrong for IMDS calls made from a VM running in
+// Azure Government, Germany or China.
+var managementResourceByCloud = map[string]string{
+	"azuremonitor":        "https://management.azure.com/",
+	"govazuremonitor":     "https://management.usgovcloudapi.net/",
+	"germanyazuremonitor": "https://management.microsoftazure.de/",
+	"chinaazuremonitor":   "https://management.chinacloudapi.cn/",
+}
+
+// managementResourceForCloud returns the ARM audience MSI tokens should be
+// requested for in the given cloud, falling back to the public cloud
+// endpoint for an unrecognized or empty cloudName.
+func managementResourceForCloud(cloudName string) string {
+	if resource, ok := managementResourceByCloud[cloudName]; ok {
+		return resource
+	}
+	return managementResourceByCloud["azuremonitor"]
+}
+
+// msiToken is an Azure AD access token obtained from the Instance
+// Metadata Service for a managed identity.
+type msiToken struct {
+	AccessToken string
+	ExpiresOn   time.Time
+}
+
+func (t *msiToken) valid(watermark time.Duration) bool {
+	return t != nil && time.Now().Before(t.ExpiresOn.Add(-watermark))
+}
+
+// imdsTokenResponse is the JSON payload returned by the IMDS token endpoint.
+type imdsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresOn   string `json:"expires_on"`
+	Resource    string `json:"resource"`
+	TokenType   string `json:"token_type"`
+}
+
+// msiTokenCache caches IMDS-issued tokens in memory, keyed by the
+// identity's client ID (empty for the system-assigned identity) and
+// the resource the token was requested for.
+type msiTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*msiToken
+}
+
+func (c *msiTokenCache) get(clientID, resource string) *msiToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[msiCacheKey(clientID, resource)]
+}
+
+func (c *msiTokenCache) set(clientID, resource string, token *msiToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[msiCacheKey(clientID, resource)] = token
+}
+
+func msiCacheKey(clientID, resource string) string {
+	return clientID + "|" + resource
+}
+
+var defaultMSITokenCache = &msiTokenCache{tokens: map[string]*msiToken{}}
+
+// getMSIAccessToken returns a bearer token for the host's managed
+// identity, serving it from the in-memory cache when one is already
+// present and not close to expiry, and otherwise fetching a fresh one
+// from IMDS. clientID may be empty to use the system-assigned identity.
+func (e *AzureMonitorDatasource) getMSIAccessToken(ctx context.Context, clientID, resource string) (string, error) {
+	watermark := time.Duration(e.dsInfo.JsonData.Get("msiTokenExpiryWatermarkMinutes").MustInt(defaultMSITokenExpiryWatermarkMinutes)) * time.Minute
+
+	if cached := defaultMSITokenCache.get(clientID, resource); cached.valid(watermark) {
+		return cached.AccessToken, nil
+	}
+
+	token, err := e.fetchMSIAccessToken(ctx, clientID, resource)
+	if err != nil {
+		return "", err
+	}
+
+	defaultMSITokenCache.set(clientID, resource, token)
+	return token.AccessToken, nil
+}
+
+func (e *AzureMonitorDatasource) fetchMSIAccessToken(ctx context.Context, clientID, resource string) (*msiToken, error) {
+	params := url.Values{}
+	params.Add("api-version", imdsAPIVersion)
+	params.Add("resource", resource)
+	if clientID != "" {
+		params.Add("client_id", clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, imdsTokenEndpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create IMDS request. error: %v", err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	res, err := ctxhttp.Do(ctx, e.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode/100 != 2 {
+		azlog.Error("IMDS token request failed", "status", res.Status, "body", string(body))
+		return nil, fmt.Errorf(string(body))
+	}
+
+	var data imdsTokenResponse
+	if err := json.Unmarshal(body, &data); err != nil {
+		azlog.Error("Failed to unmarshal IMDS token response", "error", err, "status", res.Status, "body", string(body))
+		return nil, err
+	}
+
+	expiresOn, err := strconv.ParseInt(data.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse IMDS token expiry. error: %v", err)
+	}
+
+	return &msiToken{
+		AccessToken: data.AccessToken,
+		ExpiresOn:   time.Unix(expiresOn, 0),
+	}, nil
+}
@@ -0,0 +1,339 @@
+package azuremonitor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/tsdb"
+)
+
+const (
+	// promQLMaxSamples bounds how many samples the embedded PromQL
+	// engine may touch while evaluating one query.
+	promQLMaxSamples = 50000000
+	// promQLTimeout bounds how long a single PromQL evaluation may run.
+	promQLTimeout = 30 * time.Second
+)
+
+// promQLQuery is a QueryMode: "promql" query still waiting to be
+// evaluated against Azure Monitor metrics.
+type promQLQuery struct {
+	query     *tsdb.Query
+	data      AzureMonitorData
+	startTime time.Time
+	endTime   time.Time
+}
+
+// executePromQLQuery evaluates a PromQL expression against Azure Monitor
+// metrics by handing the engine an azureMonitorQueryable, which turns
+// label matchers back into buildSingleQuery/executeQuery calls, and
+// converts the evaluated matrix back into a regular tsdb.QueryResult.
+func (e *AzureMonitorDatasource) executePromQLQuery(ctx context.Context, pq *promQLQuery) (*tsdb.QueryResult, error) {
+	queryRes := &tsdb.QueryResult{RefId: pq.query.RefId}
+
+	expr := pq.data.Query
+	if expr == "" {
+		return nil, fmt.Errorf("promql query mode requires a PromQL expression")
+	}
+
+	engine := promql.NewEngine(promql.EngineOpts{
+		MaxSamples: promQLMaxSamples,
+		Timeout:    promQLTimeout,
+	})
+
+	queryable := &azureMonitorQueryable{ctx: ctx, datasource: e, query: pq.query}
+
+	step := time.Duration(pq.query.IntervalMs) * time.Millisecond
+	if step <= 0 {
+		step = time.Minute
+	}
+
+	rangeQuery, err := engine.NewRangeQuery(queryable, expr, pq.startTime, pq.endTime, step)
+	if err != nil {
+		return nil, err
+	}
+	defer rangeQuery.Close()
+
+	result := rangeQuery.Exec(ctx)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	matrix, ok := result.Value.(promql.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("unexpected PromQL result type %T", result.Value)
+	}
+
+	for _, series := range matrix {
+		points := make([]tsdb.TimePoint, 0, len(series.Points))
+		for _, p := range series.Points {
+			if math.IsNaN(p.V) {
+				continue
+			}
+			points = append(points, tsdb.NewTimePoint(null.FloatFrom(p.V), float64(p.T)))
+		}
+		queryRes.Series = append(queryRes.Series, &tsdb.TimeSeries{
+			Name:   series.Metric.String(),
+			Points: points,
+		})
+	}
+
+	return queryRes, nil
+}
+
+// azureMonitorQueryable adapts the datasource into a Prometheus
+// storage.Queryable so the embedded PromQL engine can evaluate
+// expressions directly over Azure Monitor metrics.
+type azureMonitorQueryable struct {
+	ctx        context.Context
+	datasource *AzureMonitorDatasource
+	query      *tsdb.Query
+}
+
+func (q *azureMonitorQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &azureMonitorQuerier{
+		ctx:        ctx,
+		datasource: q.datasource,
+		query:      q.query,
+		mint:       mint,
+		maxt:       maxt,
+	}, nil
+}
+
+// azureMonitorQuerier implements storage.Querier by translating label
+// matchers into an Azure Monitor metrics query on Select. The label
+// matchers __name__, resource_group, namespace, resource_name and
+// metric_definition map onto metricnames, resourceGroup, metricnamespace,
+// the resource ID path and the resource type; any other label is treated
+// as an Azure Monitor dimension and becomes a $filter. Only one dimension
+// is filtered on: when several other labels are given, the last one wins.
+type azureMonitorQuerier struct {
+	ctx        context.Context
+	datasource *AzureMonitorDatasource
+	query      *tsdb.Query
+	mint, maxt int64
+}
+
+// translateMatchers turns a PromQL label matcher set into the
+// AzureMonitorData a query against Azure Monitor's metrics API needs:
+// __name__, resource_group, namespace, resource_name and metric_definition
+// map onto metricnames, resourceGroup, metricnamespace, the resource ID
+// path and the resource type, and any other label is treated as an Azure
+// Monitor dimension filter. Only one dimension filter is kept: when
+// several such labels are given, the last one wins.
+func translateMatchers(matchers []*labels.Matcher) AzureMonitorData {
+	data := AzureMonitorData{Aggregation: "Average"}
+
+	for _, m := range matchers {
+		switch m.Name {
+		case "__name__":
+			data.MetricName = m.Value
+		case "resource_group":
+			data.ResourceGroup = m.Value
+		case "namespace":
+			data.MetricNamespace = m.Value
+		case "resource_name":
+			data.ResourceName = m.Value
+		case "metric_definition":
+			data.MetricDefinition = m.Value
+		default:
+			data.Dimension = m.Name
+			data.DimensionFilter = m.Value
+		}
+	}
+
+	return data
+}
+
+func (q *azureMonitorQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	data := translateMatchers(matchers)
+
+	if data.ResourceName != "" {
+		series, err := q.selectSingleResource(&data)
+		if err != nil {
+			return &errSeriesSet{err: err}
+		}
+		return &azureMonitorSeriesSet{series: series, cur: -1}
+	}
+
+	series, err := q.selectAcrossResources(&data)
+	if err != nil {
+		return &errSeriesSet{err: err}
+	}
+	return &azureMonitorSeriesSet{series: series, cur: -1}
+}
+
+// selectSingleResource runs data against exactly the resource its
+// resource_name/resource_group matchers pin it to.
+func (q *azureMonitorQuerier) selectSingleResource(data *AzureMonitorData) ([]storage.Series, error) {
+	subscriptionID := q.query.Model.Get("subscription").MustString()
+	azQuery, err := q.datasource.buildSingleQuery(q.query, data, time.Unix(q.mint/1000, 0), time.Unix(q.maxt/1000, 0), subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	queryRes, resp, err := q.datasource.executeQuery(q.ctx, &azQuery, []*tsdb.Query{q.query}, &tsdb.TimeRange{})
+	if err != nil {
+		return nil, err
+	}
+	if err := q.datasource.parseResponse(queryRes, resp, &azQuery); err != nil {
+		return nil, err
+	}
+
+	metricLabels := labels.Labels{
+		{Name: "__name__", Value: data.MetricName},
+		{Name: "resource_name", Value: data.ResourceName},
+	}
+
+	series := make([]storage.Series, 0, len(queryRes.Series))
+	for _, s := range queryRes.Series {
+		series = append(series, &azureMonitorSeries{labels: metricLabels, points: s.Points})
+	}
+	return series, nil
+}
+
+// requireMetricDefinition rejects a group-by-across-resources query that
+// has no metric_definition matcher, since without one buildResourcesFilter
+// has no resourceType clause to push onto ARM and getResources would
+// otherwise enumerate and query every resource in the subscription.
+func requireMetricDefinition(data *AzureMonitorData) error {
+	if data.MetricDefinition == "" {
+		return fmt.Errorf("promql queries without a resource_name matcher must include a metric_definition matcher (e.g. metric_definition=\"Microsoft.Compute/virtualMachines\") so the resource type can be filtered server-side")
+	}
+	return nil
+}
+
+// selectAcrossResources runs data against every resource matching its
+// resource_group/metric_definition matchers, returning one
+// series per resource, since a query with no resource_name matcher is a
+// group-by across resources (e.g. "sum by (resource_name) (...)"), not a
+// query against a single, arbitrary one.
+func (q *azureMonitorQuerier) selectAcrossResources(data *AzureMonitorData) ([]storage.Series, error) {
+	if err := requireMetricDefinition(data); err != nil {
+		return nil, err
+	}
+
+	subscriptionID := q.query.Model.Get("subscription").MustString()
+	subscriptions := []interface{}{subscriptionID}
+	if data.ResourceGroup != "" {
+		data.ResourceGroups = []string{data.ResourceGroup}
+	}
+
+	resources, err := q.datasource.getResources(q.ctx, data, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	azQueries, err := q.datasource.buildResourceQueries(q.query, data, resources, time.Unix(q.mint/1000, 0), time.Unix(q.maxt/1000, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]storage.Series, 0, len(azQueries))
+	for i, azQuery := range azQueries {
+		queryRes, resp, err := q.datasource.executeQuery(q.ctx, azQuery, []*tsdb.Query{q.query}, &tsdb.TimeRange{})
+		if err != nil {
+			return nil, err
+		}
+		if err := q.datasource.parseResponse(queryRes, resp, azQuery); err != nil {
+			return nil, err
+		}
+
+		metricLabels := labels.Labels{
+			{Name: "__name__", Value: data.MetricName},
+			{Name: "resource_name", Value: resources[i].Name},
+		}
+		for _, s := range queryRes.Series {
+			series = append(series, &azureMonitorSeries{labels: metricLabels, points: s.Points})
+		}
+	}
+
+	return series, nil
+}
+
+func (q *azureMonitorQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (q *azureMonitorQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (q *azureMonitorQuerier) Close() error {
+	return nil
+}
+
+// azureMonitorSeries adapts a tsdb.TimeSeries's points into a
+// Prometheus storage.Series, materializing them as chunkenc samples on
+// the fly so the PromQL engine can evaluate aggregations, rate/increase
+// and joins across them.
+type azureMonitorSeries struct {
+	labels labels.Labels
+	points []tsdb.TimePoint
+}
+
+func (s *azureMonitorSeries) Labels() labels.Labels { return s.labels }
+
+func (s *azureMonitorSeries) Iterator() chunkenc.Iterator {
+	return &pointsIterator{points: s.points, cur: -1}
+}
+
+// pointsIterator walks a tsdb.TimeSeries's points as chunkenc samples.
+type pointsIterator struct {
+	points []tsdb.TimePoint
+	cur    int
+}
+
+func (it *pointsIterator) Seek(t int64) bool {
+	for it.cur < len(it.points)-1 {
+		it.cur++
+		if int64(it.points[it.cur][1].Float64) >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *pointsIterator) At() (int64, float64) {
+	p := it.points[it.cur]
+	return int64(p[1].Float64), p[0].Float64
+}
+
+func (it *pointsIterator) Next() bool {
+	it.cur++
+	return it.cur < len(it.points)
+}
+
+func (it *pointsIterator) Err() error { return nil }
+
+// azureMonitorSeriesSet is a static storage.SeriesSet over a slice of
+// already-fetched series.
+type azureMonitorSeriesSet struct {
+	series []storage.Series
+	cur    int
+}
+
+func (s *azureMonitorSeriesSet) Next() bool {
+	s.cur++
+	return s.cur < len(s.series)
+}
+
+func (s *azureMonitorSeriesSet) At() storage.Series         { return s.series[s.cur] }
+func (s *azureMonitorSeriesSet) Err() error                 { return nil }
+func (s *azureMonitorSeriesSet) Warnings() storage.Warnings { return nil }
+
+// errSeriesSet is a storage.SeriesSet that immediately fails with err.
+type errSeriesSet struct{ err error }
+
+func (s *errSeriesSet) Next() bool                 { return false }
+func (s *errSeriesSet) At() storage.Series         { return nil }
+func (s *errSeriesSet) Err() error                 { return s.err }
+func (s *errSeriesSet) Warnings() storage.Warnings { return nil }
@@ -0,0 +1,55 @@
+package azuremonitor
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateMatchersMapsKnownLabels(t *testing.T) {
+	data := translateMatchers([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "azure_vm_cpu_percent"),
+		labels.MustNewMatcher(labels.MatchEqual, "resource_group", "my-rg"),
+		labels.MustNewMatcher(labels.MatchEqual, "namespace", "Microsoft.Compute/virtualMachines"),
+		labels.MustNewMatcher(labels.MatchEqual, "resource_name", "vm1"),
+		labels.MustNewMatcher(labels.MatchEqual, "metric_definition", "Microsoft.Compute/virtualMachines"),
+	})
+
+	assert.Equal(t, "azure_vm_cpu_percent", data.MetricName)
+	assert.Equal(t, "my-rg", data.ResourceGroup)
+	assert.Equal(t, "Microsoft.Compute/virtualMachines", data.MetricNamespace)
+	assert.Equal(t, "vm1", data.ResourceName)
+	assert.Equal(t, "Microsoft.Compute/virtualMachines", data.MetricDefinition)
+	assert.Equal(t, "Average", data.Aggregation)
+}
+
+func TestTranslateMatchersTreatsUnknownLabelAsDimension(t *testing.T) {
+	data := translateMatchers([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "azure_vm_cpu_percent"),
+		labels.MustNewMatcher(labels.MatchEqual, "vmname", "vm1"),
+	})
+
+	assert.Equal(t, "vmname", data.Dimension)
+	assert.Equal(t, "vm1", data.DimensionFilter)
+}
+
+func TestTranslateMatchersWithoutResourceName(t *testing.T) {
+	data := translateMatchers([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "azure_vm_cpu_percent"),
+		labels.MustNewMatcher(labels.MatchEqual, "resource_group", "my-rg"),
+	})
+
+	assert.Empty(t, data.ResourceName)
+	assert.Equal(t, "my-rg", data.ResourceGroup)
+}
+
+func TestRequireMetricDefinitionRejectsEmpty(t *testing.T) {
+	err := requireMetricDefinition(&AzureMonitorData{ResourceGroup: "my-rg"})
+	assert.Error(t, err)
+}
+
+func TestRequireMetricDefinitionAllowsSet(t *testing.T) {
+	err := requireMetricDefinition(&AzureMonitorData{MetricDefinition: "Microsoft.Compute/virtualMachines"})
+	assert.NoError(t, err)
+}
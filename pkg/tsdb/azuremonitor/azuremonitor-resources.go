@@ -0,0 +1,235 @@
+package azuremonitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// defaultResourceQueryConcurrency bounds how many subscriptions are
+	// enumerated at once; it can be overridden per-datasource via the
+	// "resourceQueryConcurrency" JsonData setting.
+	defaultResourceQueryConcurrency = 5
+
+	// resourceQueryMaxRetries bounds how many times a single resources
+	// page is retried after a 429 before giving up.
+	resourceQueryMaxRetries = 5
+
+	// resourceQueryBaseBackoff is the starting backoff used when Azure
+	// doesn't send a Retry-After header; it's doubled on every retry.
+	resourceQueryBaseBackoff = 500 * time.Millisecond
+)
+
+// getResources enumerates the resources in each of the given
+// subscriptions concurrently (bounded by resourceQueryConcurrency),
+// following ARM's nextLink cursor and pushing the resource-type/location
+// filter onto the server, then narrows the merged set down to the
+// requested resource groups client-side, since ARM's /resources $filter
+// has no resourceGroup predicate. When no resource groups are requested,
+// resources from every group are kept.
+func (e *AzureMonitorDatasource) getResources(ctx context.Context, azureMonitorData *AzureMonitorData, subscriptions []interface{}) ([]resource, error) {
+	concurrency := e.dsInfo.JsonData.Get("resourceQueryConcurrency").MustInt(defaultResourceQueryConcurrency)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	filter := buildResourcesFilter(azureMonitorData)
+
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+
+	var mu sync.Mutex
+	resourcesMap := map[string]resource{}
+
+	for _, s := range subscriptions {
+		subscriptionID := fmt.Sprintf("%v", s)
+
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			resourcesResponse, err := e.executeResourcesQuery(gctx, subscriptionID, filter)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, v := range resourcesResponse.Value {
+				res := resource{
+					ID:             v.ID,
+					Name:           v.Name,
+					Type:           v.Type,
+					Location:       v.Location,
+					SubscriptionID: subscriptionID,
+				}
+
+				inGroup := len(azureMonitorData.ResourceGroups) == 0 || contains(azureMonitorData.ResourceGroups, res.ParseGroup())
+				if _, ok := resourcesMap[res.GetKey()]; !ok && inGroup {
+					resourcesMap[res.GetKey()] = res
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return []resource{}, err
+	}
+
+	resources := make([]resource, 0, len(resourcesMap))
+	for _, res := range resourcesMap {
+		resources = append(resources, res)
+	}
+
+	return resources, nil
+}
+
+// buildResourcesFilter turns the crossResource query's resource type and
+// location filters into an ARM $filter expression, so Azure does the
+// filtering instead of Grafana fetching every resource in the
+// subscription and discarding most of them.
+func buildResourcesFilter(azureMonitorData *AzureMonitorData) string {
+	clauses := []string{}
+
+	if azureMonitorData.MetricDefinition != "" {
+		clauses = append(clauses, fmt.Sprintf("resourceType eq '%s'", azureMonitorData.MetricDefinition))
+	}
+
+	if clause := eqOrClause("location", azureMonitorData.Locations); clause != "" {
+		clauses = append(clauses, clause)
+	}
+
+	return strings.Join(clauses, " and ")
+}
+
+// eqOrClause builds an ARM $filter clause matching any of values against
+// field, e.g. "(location eq 'eastus' or location eq 'westus')".
+func eqOrClause(field string, values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%s eq '%s'", field, v)
+	}
+	if len(parts) == 1 {
+		return parts[0]
+	}
+
+	return "(" + strings.Join(parts, " or ") + ")"
+}
+
+// executeResourcesQuery fetches every resource for a subscription,
+// following ARM's nextLink cursor until it's exhausted so subscriptions
+// with more resources than the default page size aren't silently
+// truncated.
+func (e *AzureMonitorDatasource) executeResourcesQuery(ctx context.Context, subscriptionID string, filter string) (ResourcesResponse, error) {
+	params := url.Values{}
+	params.Add("api-version", "2018-01-01")
+	if filter != "" {
+		params.Add("$filter", filter)
+	}
+
+	merged := ResourcesResponse{}
+	nextLink := ""
+
+	for {
+		req, err := e.createRequest(ctx, e.dsInfo)
+		if err != nil {
+			return ResourcesResponse{}, err
+		}
+
+		if nextLink != "" {
+			parsed, err := url.Parse(nextLink)
+			if err != nil {
+				return ResourcesResponse{}, err
+			}
+			req.URL.Path = parsed.Path
+			req.URL.RawQuery = parsed.RawQuery
+		} else {
+			req.URL.Path = path.Join(req.URL.Path, subscriptionID, "resources")
+			req.URL.RawQuery = params.Encode()
+		}
+
+		res, err := e.doResourcesRequestWithRetry(ctx, req)
+		if err != nil {
+			return ResourcesResponse{}, err
+		}
+
+		data, err := e.unmarshalResourcesResponse(res)
+		if err != nil {
+			return ResourcesResponse{}, err
+		}
+
+		merged.Value = append(merged.Value, data.Value...)
+
+		if data.NextLink == "" {
+			break
+		}
+		nextLink = data.NextLink
+	}
+
+	return merged, nil
+}
+
+// doResourcesRequestWithRetry executes req, retrying with exponential
+// backoff on 429 responses and honoring the Retry-After header, since
+// resource enumeration is the biggest source of throttling for
+// cross-resource dashboards.
+func (e *AzureMonitorDatasource) doResourcesRequestWithRetry(ctx context.Context, req *http.Request) (*http.Response, error) {
+	backoff := resourceQueryBaseBackoff
+
+	for attempt := 0; ; attempt++ {
+		res, err := ctxhttp.Do(ctx, e.httpClient, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode != http.StatusTooManyRequests || attempt >= resourceQueryMaxRetries {
+			return res, nil
+		}
+
+		wait := retryAfterDuration(res.Header.Get("Retry-After"), backoff)
+		res.Body.Close()
+
+		azlog.Debug("AzureMonitor", "resource query throttled, retrying", "attempt", attempt+1, "wait", wait)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+	}
+}
+
+// retryAfterDuration parses an HTTP Retry-After header (either a number
+// of seconds or an HTTP-date) and falls back to the given backoff if the
+// header is absent or unparsable.
+func retryAfterDuration(header string, fallback time.Duration) time.Duration {
+	if header == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
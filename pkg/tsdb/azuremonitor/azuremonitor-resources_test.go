@@ -0,0 +1,98 @@
+package azuremonitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfterDurationParsesSeconds(t *testing.T) {
+	d := retryAfterDuration("5", time.Second)
+	assert.Equal(t, 5*time.Second, d)
+}
+
+func TestRetryAfterDurationParsesHTTPDate(t *testing.T) {
+	future := time.Now().Add(30 * time.Second).UTC()
+	d := retryAfterDuration(future.Format(http.TimeFormat), time.Second)
+
+	assert.True(t, d > 20*time.Second && d <= 30*time.Second, "expected ~30s, got %s", d)
+}
+
+func TestRetryAfterDurationFallsBackOnMissingOrUnparsableHeader(t *testing.T) {
+	assert.Equal(t, 2*time.Second, retryAfterDuration("", 2*time.Second))
+	assert.Equal(t, 2*time.Second, retryAfterDuration("not-a-duration", 2*time.Second))
+}
+
+func TestEqOrClause(t *testing.T) {
+	assert.Equal(t, "", eqOrClause("location", nil))
+	assert.Equal(t, "location eq 'eastus'", eqOrClause("location", []string{"eastus"}))
+	assert.Equal(t, "(location eq 'eastus' or location eq 'westus')", eqOrClause("location", []string{"eastus", "westus"}))
+}
+
+func TestBuildResourcesFilter(t *testing.T) {
+	data := &AzureMonitorData{
+		MetricDefinition: "Microsoft.Compute/virtualMachines",
+		Locations:        []string{"eastus", "westus"},
+	}
+
+	filter := buildResourcesFilter(data)
+
+	assert.Equal(t, "resourceType eq 'Microsoft.Compute/virtualMachines' and (location eq 'eastus' or location eq 'westus')", filter)
+}
+
+func TestBuildResourcesFilterEmpty(t *testing.T) {
+	assert.Equal(t, "", buildResourcesFilter(&AzureMonitorData{}))
+}
+
+func TestDoResourcesRequestWithRetryRetriesOn429(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	e := &AzureMonitorDatasource{httpClient: server.Client()}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	res, err := e.doResourcesRequestWithRetry(context.Background(), req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDoResourcesRequestWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	e := &AzureMonitorDatasource{httpClient: server.Client()}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	res, err := e.doResourcesRequestWithRetry(context.Background(), req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, resourceQueryMaxRetries+1, attempts)
+}